@@ -14,12 +14,21 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"container/heap"
 	"encoding/binary"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path"
+	"runtime"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/juju/errors"
@@ -28,6 +37,99 @@ import (
 	"github.com/pingcap/tidb/util/types"
 )
 
+const (
+	// defaultChunkSize is the uncompressed size threshold, in bytes, at
+	// which a chunkWriter flushes the chunk it is buffering.
+	defaultChunkSize = 64 * 1024
+	// rowHeaderSize is the length of encodeRow's row-length prefix.
+	rowHeaderSize = 8
+	// trailerSize is the length of the fixed-size trailer that closes a
+	// chunked file: the footer TOC's offset and length, as uint64s.
+	trailerSize = 16
+)
+
+// Supported -compression values. Compression is applied independently
+// to each chunk, so a reader can decompress one chunk without touching
+// its neighbors.
+//
+// TODO(vendoring owner): zstd is not offered here yet. It needs
+// github.com/klauspost/compress, which isn't vendored into this tree,
+// and this package doesn't vendor its own dependencies out-of-band of
+// the rest of the repo. This is a gap against the original request,
+// not a closed-out substitute for it: vendor the dependency and wire
+// compressionZstd/algoZstd back in (compressChunk/decompressChunk had
+// working gzip-shaped cases for it before they were pulled).
+const (
+	compressionNone = "none"
+	compressionGzip = "gzip"
+	// compressionZstd is recognized by algoByID only to give a precise
+	// error pointing at the TODO above, distinct from a plain typo in
+	// -compression; it has no corresponding algoZstd or codec path.
+	compressionZstd = "zstd"
+)
+
+// Algorithm IDs stored per chunk in the TOC, so each chunk can be
+// decompressed on its own even if -compression changes between runs.
+const (
+	algoNone byte = iota
+	algoGzip
+)
+
+func algoByID(compression string) (byte, error) {
+	switch compression {
+	case "", compressionNone:
+		return algoNone, nil
+	case compressionGzip:
+		return algoGzip, nil
+	case compressionZstd:
+		return 0, errors.New("compression \"zstd\" is not available: github.com/klauspost/compress isn't vendored into this tree yet (see the TODO above compressionNone)")
+	default:
+		return 0, errors.Errorf("unknown compression %q", compression)
+	}
+}
+
+// compressChunk compresses raw, the encoded rows of one chunk, using
+// algo.
+func compressChunk(algo byte, raw []byte) ([]byte, error) {
+	switch algo {
+	case algoNone:
+		return raw, nil
+	case algoGzip:
+		var buf bytes.Buffer
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(raw); err != nil {
+			return nil, errors.Trace(err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, errors.Trace(err)
+		}
+		return buf.Bytes(), nil
+	default:
+		return nil, errors.Errorf("unknown compression algo %d", algo)
+	}
+}
+
+// decompressChunk reverses compressChunk for one chunk's raw bytes.
+func decompressChunk(algo byte, raw []byte) ([]byte, error) {
+	switch algo {
+	case algoNone:
+		return raw, nil
+	case algoGzip:
+		r, err := gzip.NewReader(bytes.NewReader(raw))
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		defer r.Close()
+		uncompressed, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		return uncompressed, nil
+	default:
+		return nil, errors.Errorf("unknown compression algo %d", algo)
+	}
+}
+
 type comparableRow struct {
 	key    []types.Datum
 	val    []types.Datum
@@ -47,6 +149,9 @@ var (
 	scale       int
 	inputRatio  int
 	outputRatio int
+	chunkSize   int
+	compression string
+	parallel    int
 )
 
 func nextRow(r *rand.Rand, keySize int, valSize int) *comparableRow {
@@ -93,30 +198,27 @@ func encodeRow(b []byte, row *comparableRow) ([]byte, error) {
 	return b, nil
 }
 
-func decodeRow(fd *os.File) (*comparableRow, error) {
+// decodeRow reads one encodeRow-framed row from r. It returns io.EOF,
+// unwrapped, when r is exhausted exactly on a row boundary, so callers
+// can use it to drain a chunk (or file) of unknown row count.
+func decodeRow(r io.Reader) (*comparableRow, error) {
 	var (
 		err  error
-		n    int
 		head = make([]byte, 8)
 		dcod = make([]types.Datum, 0, keySize+valSize+1)
 	)
 
-	n, err = fd.Read(head)
-	if n != 8 {
-		return nil, errors.New("incorrect header")
-	}
-	if err != nil {
+	if _, err = io.ReadFull(r, head); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
 		return nil, errors.Trace(err)
 	}
 
 	rowSize := int(binary.BigEndian.Uint64(head))
 	rowBytes := make([]byte, rowSize)
 
-	n, err = fd.Read(rowBytes)
-	if n != rowSize {
-		return nil, errors.New("incorrect row")
-	}
-	if err != nil {
+	if _, err = io.ReadFull(r, rowBytes); err != nil {
 		return nil, errors.Trace(err)
 	}
 
@@ -172,81 +274,771 @@ func decodeMeta(fd *os.File) error {
 	return nil
 }
 
-func export() error {
-	var (
-		err         error
-		outputBytes []byte
-		outputFile  *os.File
-	)
+// chunkTOCEntry describes one chunk of a chunked file, as recorded in
+// the file's footer table of contents.
+type chunkTOCEntry struct {
+	algo             byte // compression algorithm this chunk was written with
+	firstKeyOffset   int64
+	uncompressedSize int64
+	compressedSize   int64
+	fileOffset       int64
+	firstKey         []types.Datum
+}
 
-	fileName := path.Join(tmpDir, "data.out")
-	outputFile, err = os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+// chunkWriter buffers encoded rows and flushes them to w in fixed-size
+// chunks, compressing each chunk independently with the configured
+// algorithm and recording a chunkTOCEntry for it so a footer TOC can
+// support chunk-level random access on read. Chunks never split a row.
+type chunkWriter struct {
+	w           io.Writer
+	chunkSize   int
+	compression string
+	buf         []byte
+	firstKey    []types.Datum
+	fileOff     int64
+	toc         []chunkTOCEntry
+}
+
+// newChunkWriter returns a chunkWriter that writes to w starting at
+// startOffset, which must be w's current absolute write position (e.g.
+// past a meta header already written to the same file). Each chunk is
+// compressed independently with compression (one of the compression*
+// constants) once it reaches chunkSize uncompressed bytes.
+func newChunkWriter(w io.Writer, chunkSize int, compression string, startOffset int64) *chunkWriter {
+	return &chunkWriter{w: w, chunkSize: chunkSize, compression: compression, fileOff: startOffset}
+}
+
+// WriteRow appends row to the current chunk, flushing it once it
+// reaches chunkSize uncompressed bytes.
+func (cw *chunkWriter) WriteRow(row *comparableRow) error {
+	if len(cw.buf) == 0 {
+		cw.firstKey = row.key
+	}
+	var err error
+	cw.buf, err = encodeRow(cw.buf, row)
 	if err != nil {
 		return errors.Trace(err)
 	}
-	defer outputFile.Close()
+	if len(cw.buf) >= cw.chunkSize {
+		return cw.flush()
+	}
+	return nil
+}
+
+func (cw *chunkWriter) flush() error {
+	if len(cw.buf) == 0 {
+		return nil
+	}
+
+	algo, err := algoByID(cw.compression)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	compressed, err := compressChunk(algo, cw.buf)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	n, err := cw.w.Write(compressed)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	cw.toc = append(cw.toc, chunkTOCEntry{
+		algo:             algo,
+		firstKeyOffset:   rowHeaderSize,
+		uncompressedSize: int64(len(cw.buf)),
+		compressedSize:   int64(n),
+		fileOffset:       cw.fileOff,
+		firstKey:         cw.firstKey,
+	})
+	cw.fileOff += int64(n)
+	cw.buf = cw.buf[:0]
+	cw.firstKey = nil
+	return nil
+}
+
+// Close flushes any buffered rows and returns the completed TOC.
+func (cw *chunkWriter) Close() ([]chunkTOCEntry, error) {
+	if err := cw.flush(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return cw.toc, nil
+}
+
+// encodeTOC serializes a chunk TOC as an entry count followed by, for each
+// entry, its compression algo byte, its four int64 fields, and a
+// length-prefixed encoded key.
+func encodeTOC(toc []chunkTOCEntry) ([]byte, error) {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(len(toc)))
+
+	field := make([]byte, 8)
+	for _, e := range toc {
+		b = append(b, e.algo)
+
+		for _, v := range []int64{e.firstKeyOffset, e.uncompressedSize, e.compressedSize, e.fileOffset} {
+			binary.BigEndian.PutUint64(field, uint64(v))
+			b = append(b, field...)
+		}
+
+		keyBytes, err := codec.EncodeKey(nil, e.firstKey...)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		binary.BigEndian.PutUint64(field, uint64(len(keyBytes)))
+		b = append(b, field...)
+		b = append(b, keyBytes...)
+	}
+
+	return b, nil
+}
 
-	outputBytes = encodeMeta(outputBytes, scale, keySize, valSize)
+func decodeTOC(b []byte) ([]chunkTOCEntry, error) {
+	if len(b) < 8 {
+		return nil, errors.New("incorrect TOC")
+	}
+	n := int(binary.BigEndian.Uint64(b[:8]))
+	b = b[8:]
 
-	seed := rand.NewSource(time.Now().UnixNano())
-	r := rand.New(seed)
+	toc := make([]chunkTOCEntry, 0, n)
+	for i := 0; i < n; i++ {
+		if len(b) < 41 {
+			return nil, errors.New("incorrect TOC entry")
+		}
+		e := chunkTOCEntry{
+			algo:             b[0],
+			firstKeyOffset:   int64(binary.BigEndian.Uint64(b[1:9])),
+			uncompressedSize: int64(binary.BigEndian.Uint64(b[9:17])),
+			compressedSize:   int64(binary.BigEndian.Uint64(b[17:25])),
+			fileOffset:       int64(binary.BigEndian.Uint64(b[25:33])),
+		}
+		keyLen := int(binary.BigEndian.Uint64(b[33:41]))
+		b = b[41:]
 
-	for i := 1; i <= scale; i++ {
-		outputBytes, err = encodeRow(outputBytes, nextRow(r, keySize, valSize))
+		if len(b) < keyLen {
+			return nil, errors.New("incorrect TOC entry key")
+		}
+		key, err := codec.Decode(b[:keyLen], keySize)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		e.firstKey = key
+		b = b[keyLen:]
+
+		toc = append(toc, e)
+	}
+
+	return toc, nil
+}
+
+// writeFooter appends the chunk TOC and a fixed-size trailer (the
+// TOC's offset and length) to fd, so a reader can locate the TOC with
+// a single seek-to-end-and-read instead of scanning every chunk.
+func writeFooter(fd *os.File, toc []chunkTOCEntry) error {
+	tocOffset, err := fd.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return errors.Trace(err)
+	}
+
+	tocBytes, err := encodeTOC(toc)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if _, err = fd.Write(tocBytes); err != nil {
+		return errors.Trace(err)
+	}
+
+	trailer := make([]byte, trailerSize)
+	binary.BigEndian.PutUint64(trailer[:8], uint64(tocOffset))
+	binary.BigEndian.PutUint64(trailer[8:], uint64(len(tocBytes)))
+	_, err = fd.Write(trailer)
+	return errors.Trace(err)
+}
+
+// readTOC reads a chunked file's footer TOC via its trailer, seeking
+// straight to it instead of scanning the chunks that precede it.
+func readTOC(fd *os.File) ([]chunkTOCEntry, error) {
+	fi, err := fd.Stat()
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	trailer := make([]byte, trailerSize)
+	if _, err = fd.ReadAt(trailer, fi.Size()-trailerSize); err != nil {
+		return nil, errors.Trace(err)
+	}
+	tocOffset := int64(binary.BigEndian.Uint64(trailer[:8]))
+	tocLength := int64(binary.BigEndian.Uint64(trailer[8:]))
+
+	tocBytes := make([]byte, tocLength)
+	if _, err = fd.ReadAt(tocBytes, tocOffset); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	return decodeTOC(tocBytes)
+}
+
+// chunkReader provides chunk-at-a-time access to a chunked file via its
+// footer TOC, so a caller can read any chunk's bytes directly by its
+// recorded fileOffset rather than scanning from the first row.
+type chunkReader struct {
+	fd  *os.File
+	toc []chunkTOCEntry
+}
+
+func newChunkReader(fd *os.File) (*chunkReader, error) {
+	toc, err := readTOC(fd)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	return &chunkReader{fd: fd, toc: toc}, nil
+}
+
+func (cr *chunkReader) numChunks() int { return len(cr.toc) }
+
+// readChunk reads, decompresses, and decodes every row in chunk i.
+func (cr *chunkReader) readChunk(i int) ([]*comparableRow, error) {
+	entry := cr.toc[i]
+	raw := make([]byte, entry.compressedSize)
+	if _, err := cr.fd.ReadAt(raw, entry.fileOffset); err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	uncompressed, err := decompressChunk(entry.algo, raw)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+
+	var rows []*comparableRow
+	r := bytes.NewReader(uncompressed)
+	for r.Len() > 0 {
+		row, err := decodeRow(r)
+		if err != nil {
+			return nil, errors.Trace(err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// chunkRowCursor steps through every row of a chunked file in order,
+// reading one chunk at a time via chunkReader rather than scanning
+// from the first row, so a partial-ratio read only pays for the chunks
+// it actually needs.
+type chunkRowCursor struct {
+	fd       *os.File
+	cr       *chunkReader
+	chunkIdx int
+	rows     []*comparableRow
+	rowIdx   int
+	row      *comparableRow
+}
+
+func newChunkRowCursor(fd *os.File) (*chunkRowCursor, error) {
+	cr, err := newChunkReader(fd)
+	if err != nil {
+		return nil, errors.Trace(err)
+	}
+	c := &chunkRowCursor{fd: fd, cr: cr, chunkIdx: -1, rowIdx: -1}
+	if err := c.advance(); err != nil {
+		return nil, errors.Trace(err)
+	}
+	return c, nil
+}
+
+// advance moves to the next row, pulling in the next chunk lazily when
+// the current one is exhausted, and sets c.row to nil once every chunk
+// has been read.
+func (c *chunkRowCursor) advance() error {
+	c.rowIdx++
+	for c.rowIdx >= len(c.rows) {
+		c.chunkIdx++
+		if c.chunkIdx >= c.cr.numChunks() {
+			c.row = nil
+			return nil
+		}
+		rows, err := c.cr.readChunk(c.chunkIdx)
 		if err != nil {
 			return errors.Trace(err)
 		}
+		c.rows = rows
+		c.rowIdx = 0
 	}
+	c.row = c.rows[c.rowIdx]
+	return nil
+}
 
-	_, err = outputFile.Write(outputBytes)
+// chunkPayload is one compressed chunk produced by a row-generating
+// worker, ready to be appended to the output file by the single writer
+// goroutine that owns it and its TOC.
+type chunkPayload struct {
+	algo             byte
+	compressed       []byte
+	uncompressedSize int64
+	firstKey         []types.Datum
+}
+
+// chunkBuilder buffers encoded rows exactly like chunkWriter, but hands
+// each completed, compressed chunk to out instead of writing it
+// directly, so row generation and compression can run on worker
+// goroutines while a single writer goroutine serializes writes to the
+// output file.
+type chunkBuilder struct {
+	chunkSize   int
+	compression string
+	buf         []byte
+	firstKey    []types.Datum
+	out         chan<- chunkPayload
+}
+
+func newChunkBuilder(chunkSize int, compression string, out chan<- chunkPayload) *chunkBuilder {
+	return &chunkBuilder{chunkSize: chunkSize, compression: compression, out: out}
+}
+
+func (cb *chunkBuilder) WriteRow(row *comparableRow) error {
+	if len(cb.buf) == 0 {
+		cb.firstKey = row.key
+	}
+	var err error
+	cb.buf, err = encodeRow(cb.buf, row)
 	if err != nil {
 		return errors.Trace(err)
 	}
+	if len(cb.buf) >= cb.chunkSize {
+		return cb.flush()
+	}
+	return nil
+}
 
+func (cb *chunkBuilder) flush() error {
+	if len(cb.buf) == 0 {
+		return nil
+	}
+
+	algo, err := algoByID(cb.compression)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	compressed, err := compressChunk(algo, cb.buf)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	if algo == algoNone {
+		// compressChunk(algoNone, ...) returns cb.buf itself, not a
+		// copy. cb.buf gets reused for the next chunk as soon as this
+		// send completes, while the payload can still be sitting
+		// unread in the bounded channel, so it must be copied before
+		// it's handed off.
+		owned := make([]byte, len(compressed))
+		copy(owned, compressed)
+		compressed = owned
+	}
+
+	cb.out <- chunkPayload{
+		algo:             algo,
+		compressed:       compressed,
+		uncompressedSize: int64(len(cb.buf)),
+		firstKey:         cb.firstKey,
+	}
+	cb.buf = cb.buf[:0]
+	cb.firstKey = nil
 	return nil
 }
 
-func load(ratio int) ([]*comparableRow, error) {
-	var (
-		err error
-		fd  *os.File
-	)
+// Close flushes any buffered rows.
+func (cb *chunkBuilder) Close() error {
+	return errors.Trace(cb.flush())
+}
 
+// export generates scale rows across parallel worker goroutines, each
+// seeded from its own rand.Source, and funnels their compressed chunks
+// through a bounded channel to a single writer goroutine that owns
+// data.out and assembles its footer TOC.
+func export() error {
 	fileName := path.Join(tmpDir, "data.out")
-	fd, err = os.Open(fileName)
-	if os.IsNotExist(err) {
-		return nil, errors.New("data file (data.out) does not exist")
+	outputFile, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer outputFile.Close()
+
+	metaBytes := encodeMeta(nil, scale, keySize, valSize)
+	if _, err = outputFile.Write(metaBytes); err != nil {
+		return errors.Trace(err)
+	}
+
+	chunks := make(chan chunkPayload, parallel)
+	workerErrs := make([]error, parallel)
+
+	var workers sync.WaitGroup
+	rowsPerWorker := scale / parallel
+	for w := 0; w < parallel; w++ {
+		rows := rowsPerWorker
+		if w == parallel-1 {
+			rows = scale - rowsPerWorker*(parallel-1)
+		}
+
+		workers.Add(1)
+		go func(w, rows int) {
+			defer workers.Done()
+
+			r := rand.New(rand.NewSource(time.Now().UnixNano() + int64(w)))
+			cb := newChunkBuilder(chunkSize, compression, chunks)
+			for i := 0; i < rows; i++ {
+				if werr := cb.WriteRow(nextRow(r, keySize, valSize)); werr != nil {
+					workerErrs[w] = errors.Trace(werr)
+					return
+				}
+			}
+			if werr := cb.Close(); werr != nil {
+				workerErrs[w] = errors.Trace(werr)
+			}
+		}(w, rows)
+	}
+
+	go func() {
+		workers.Wait()
+		close(chunks)
+	}()
+
+	fileOff := int64(len(metaBytes))
+	var toc []chunkTOCEntry
+	for payload := range chunks {
+		n, werr := outputFile.Write(payload.compressed)
+		if werr != nil {
+			return errors.Trace(werr)
+		}
+		toc = append(toc, chunkTOCEntry{
+			algo:             payload.algo,
+			firstKeyOffset:   rowHeaderSize,
+			uncompressedSize: payload.uncompressedSize,
+			compressedSize:   int64(n),
+			fileOffset:       fileOff,
+			firstKey:         payload.firstKey,
+		})
+		fileOff += int64(n)
+	}
+
+	for _, werr := range workerErrs {
+		if werr != nil {
+			return werr
+		}
 	}
+
+	return errors.Trace(writeFooter(outputFile, toc))
+}
+
+// compareKeys compares two rows' sort keys datum-by-datum, in the same
+// way an ORDER BY over all key columns would.
+func compareKeys(a, b []types.Datum) (int, error) {
+	for i := range a {
+		cmp, err := a[i].CompareDatum(b[i])
+		if err != nil {
+			return 0, errors.Trace(err)
+		}
+		if cmp != 0 {
+			return cmp, nil
+		}
+	}
+	return 0, nil
+}
+
+// sortBatch sorts rows in place by key, ascending.
+func sortBatch(rows []*comparableRow) error {
+	var sortErr error
+	sort.Slice(rows, func(i, j int) bool {
+		if sortErr != nil {
+			return false
+		}
+		cmp, err := compareKeys(rows[i].key, rows[j].key)
+		if err != nil {
+			sortErr = err
+			return false
+		}
+		return cmp < 0
+	})
+	return errors.Trace(sortErr)
+}
+
+// spillRun writes a sorted batch to a new numbered, chunked run file in
+// tmpDir and returns its path.
+func spillRun(runID int, rows []*comparableRow) (string, error) {
+	runFile := path.Join(tmpDir, fmt.Sprintf("run-%d.dat", runID))
+	fd, err := os.OpenFile(runFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
 	if err != nil {
-		return nil, errors.Trace(err)
+		return "", errors.Trace(err)
 	}
 	defer fd.Close()
 
-	err = decodeMeta(fd)
+	cw := newChunkWriter(fd, chunkSize, compression, 0)
+	for _, row := range rows {
+		if err = cw.WriteRow(row); err != nil {
+			return "", errors.Trace(err)
+		}
+	}
+
+	toc, err := cw.Close()
+	if err != nil {
+		return "", errors.Trace(err)
+	}
+	if err = writeFooter(fd, toc); err != nil {
+		return "", errors.Trace(err)
+	}
+
+	return runFile, nil
+}
+
+// openChunkRowCursor opens file and positions a chunkRowCursor over it.
+func openChunkRowCursor(file string) (*chunkRowCursor, error) {
+	fd, err := os.Open(file)
 	if err != nil {
 		return nil, errors.Trace(err)
 	}
+	c, err := newChunkRowCursor(fd)
+	if err != nil {
+		fd.Close()
+		return nil, errors.Trace(err)
+	}
+	return c, nil
+}
+
+// spillJob is one batch handed to the parallel spill worker pool: sort
+// it, then spill it to its own run file.
+type spillJob struct {
+	runID int
+	rows  []*comparableRow
+}
 
-	cLogf("\tnumber of rows = %d, key size = %d, value size = %d", scale, keySize, valSize)
+// partitionAndSpill reads totalRows rows from in, a cursor over
+// data.out, in batches of bufSize. Because in reads chunk-by-chunk via
+// the footer TOC, a partial-ratio totalRows never touches chunks past
+// the ones it needs. Each batch is handed to a pool of parallel worker
+// goroutines that sort and spill it to its own run file concurrently;
+// the jobs channel is bounded, so reading blocks once parallel batches
+// are already in flight rather than holding all of them in memory at
+// once. It returns the spilled run files in no particular order, along
+// with partitionTime (time spent reading/batching) and spillTime (the
+// combined time the worker pool spent sorting and spilling batches,
+// summed across workers since they run concurrently), measured
+// separately so each phase can be benchmarked on its own.
+func partitionAndSpill(in *chunkRowCursor, totalRows int) (runFiles []string, partitionTime, spillTime time.Duration, err error) {
+	jobs := make(chan spillJob, parallel)
+	results := make(chan string, parallel)
+	errs := make(chan error, parallel)
 
-	var (
-		row  *comparableRow
-		data = make([]*comparableRow, 0, scale)
-	)
+	var spillMu sync.Mutex
+	var workers sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for job := range jobs {
+				jobStart := time.Now()
+				serr := sortBatch(job.rows)
+				var runFile string
+				if serr == nil {
+					runFile, serr = spillRun(job.runID, job.rows)
+				}
+				spillMu.Lock()
+				spillTime += time.Since(jobStart)
+				spillMu.Unlock()
+
+				if serr != nil {
+					errs <- errors.Trace(serr)
+					continue
+				}
+				results <- runFile
+			}
+		}()
+	}
+
+	var collector sync.WaitGroup
+	collector.Add(1)
+	go func() {
+		defer collector.Done()
+		for runFile := range results {
+			runFiles = append(runFiles, runFile)
+		}
+	}()
+
+	var workerErr error
+	var errCollector sync.WaitGroup
+	errCollector.Add(1)
+	go func() {
+		defer errCollector.Done()
+		for serr := range errs {
+			if workerErr == nil {
+				workerErr = serr
+			}
+		}
+	}()
+
+	runID := 0
+	batch := make([]*comparableRow, 0, bufSize)
+	dispatch := func() {
+		if len(batch) == 0 {
+			return
+		}
+		jobs <- spillJob{runID: runID, rows: batch}
+		runID++
+		batch = make([]*comparableRow, 0, bufSize)
+	}
 
-	totalRows := int(float64(scale) * (float64(ratio) / 100.0))
-	cLogf("\tload %d rows", totalRows)
-	for i := 1; i <= totalRows; i++ {
-		row, err = decodeRow(fd)
+	for i := 0; i < totalRows; i++ {
+		partitionStart := time.Now()
+		if in.row == nil {
+			partitionTime += time.Since(partitionStart)
+			err = errors.New("data.out has fewer rows than inputRatio requires")
+			break
+		}
+		row := in.row
+		// Advancing past the last needed row could load a chunk that no
+		// batch uses, so the cursor is only moved while rows remain.
+		var aerr error
+		if i+1 < totalRows {
+			aerr = in.advance()
+		}
+		partitionTime += time.Since(partitionStart)
+		if aerr != nil {
+			err = errors.Trace(aerr)
+			break
+		}
+
+		batch = append(batch, row)
+		if len(batch) == bufSize {
+			dispatch()
+		}
+	}
+	if err == nil {
+		dispatch()
+	}
+
+	close(jobs)
+	workers.Wait()
+	close(results)
+	collector.Wait()
+	close(errs)
+	errCollector.Wait()
+
+	if err == nil {
+		err = workerErr
+	}
+	return
+}
+
+// runHeap is a container/heap min-heap of chunkRowCursors, ordered by
+// the key of each run's current row.
+type runHeap struct {
+	cursors []*chunkRowCursor
+	err     error
+}
+
+func (h *runHeap) Len() int { return len(h.cursors) }
+
+func (h *runHeap) Less(i, j int) bool {
+	cmp, err := compareKeys(h.cursors[i].row.key, h.cursors[j].row.key)
+	if err != nil {
+		h.err = err
+		return false
+	}
+	return cmp < 0
+}
+
+func (h *runHeap) Swap(i, j int) { h.cursors[i], h.cursors[j] = h.cursors[j], h.cursors[i] }
+
+func (h *runHeap) Push(x interface{}) { h.cursors = append(h.cursors, x.(*chunkRowCursor)) }
+
+func (h *runHeap) Pop() interface{} {
+	old := h.cursors
+	n := len(old)
+	item := old[n-1]
+	h.cursors = old[:n-1]
+	return item
+}
+
+// mergeRuns k-way merges the given sorted run files into tmpDir's
+// sorted.out, writing at most totalOutputRows rows, then removes the
+// run files.
+func mergeRuns(runFiles []string, totalOutputRows int) error {
+	outFile := path.Join(tmpDir, "sorted.out")
+	fd, err := os.OpenFile(outFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return errors.Trace(err)
+	}
+	defer fd.Close()
+
+	h := &runHeap{}
+	for _, runFile := range runFiles {
+		defer os.Remove(runFile)
+
+		c, cerr := openChunkRowCursor(runFile)
+		if cerr != nil {
+			return errors.Trace(cerr)
+		}
+		defer c.fd.Close()
+		if c.row != nil {
+			heap.Push(h, c)
+		}
+	}
+
+	// Write each row to fd as it's produced, through a small bufio
+	// buffer, rather than accumulating the whole (potentially
+	// scale-sized) output in memory before the first byte goes out.
+	w := bufio.NewWriter(fd)
+
+	var buf []byte
+	written := 0
+	for h.Len() > 0 && written < totalOutputRows {
+		c := heap.Pop(h).(*chunkRowCursor)
+		if h.err != nil {
+			return errors.Trace(h.err)
+		}
+
+		buf, err = encodeRow(buf[:0], c.row)
 		if err != nil {
-			return nil, errors.Trace(err)
+			return errors.Trace(err)
+		}
+		if _, err = w.Write(buf); err != nil {
+			return errors.Trace(err)
+		}
+		written++
+
+		if written >= totalOutputRows {
+			// The output cap is reached, so this merge stops here.
+			// chunkRowCursor.advance only ever loads a chunk lazily,
+			// on demand, so the remaining cursors' unread chunks were
+			// never going to be touched by this merge regardless; log
+			// how many rounds of I/O that amounts to, for visibility,
+			// rather than claiming this comparison skips anything it
+			// wouldn't have skipped anyway.
+			if n := neverReadChunks(append(h.cursors, c)); n > 0 {
+				cLogf("\t%d chunk(s) never read (output cap reached)", n)
+			}
+			break
+		}
+
+		if err = c.advance(); err != nil {
+			return errors.Trace(err)
+		}
+		if c.row != nil {
+			heap.Push(h, c)
 		}
-		// cLogf("key: %d, val: %d, handle: %d",
-		// row.key[0].GetInt64(), row.val[0].GetInt64(), row.handle)
-		data = append(data, row)
 	}
 
-	return data, nil
+	return errors.Trace(w.Flush())
+}
+
+// neverReadChunks counts the chunks across cursors that were never
+// read into memory, per their TOC's chunk count. This is a diagnostic,
+// not an optimization: chunkRowCursor already only reads a chunk when
+// a row from it is requested, so it never reads these regardless of
+// whether anything here counts them.
+func neverReadChunks(cursors []*chunkRowCursor) int {
+	n := 0
+	for _, c := range cursors {
+		n += c.cr.numChunks() - c.chunkIdx - 1
+	}
+	return n
 }
 
 func init() {
@@ -261,11 +1053,17 @@ func init() {
 	genCmd.IntVar(&keySize, "keySize", 8, "the size of key")
 	genCmd.IntVar(&valSize, "valSize", 8, "the size of vlaue")
 	genCmd.IntVar(&scale, "scale", 100, "how many rows to generate")
+	genCmd.IntVar(&chunkSize, "chunkSize", defaultChunkSize, "uncompressed size, in bytes, of each chunk in data.out")
+	genCmd.StringVar(&compression, "compression", compressionNone, "per-chunk compression for data.out: none or gzip (zstd pending dependency vendoring)")
+	genCmd.IntVar(&parallel, "parallel", runtime.GOMAXPROCS(0), "how many goroutines generate rows concurrently")
 
 	runCmd.StringVar(&tmpDir, "dir", cwd, "where to load the generated rows")
 	runCmd.IntVar(&bufSize, "bufSize", 500000, "how many rows held in memory at a time")
 	runCmd.IntVar(&inputRatio, "inputRatio", 100, "input percentage")
 	runCmd.IntVar(&outputRatio, "outputRatio", 100, "output percentage")
+	runCmd.IntVar(&chunkSize, "chunkSize", defaultChunkSize, "uncompressed size, in bytes, of each spilled run's chunks")
+	runCmd.StringVar(&compression, "compression", compressionNone, "per-chunk compression for spilled runs: none or gzip (zstd pending dependency vendoring)")
+	runCmd.IntVar(&parallel, "parallel", runtime.GOMAXPROCS(0), "how many goroutines sort and spill batches concurrently")
 }
 
 func main() {
@@ -303,6 +1101,15 @@ func main() {
 		if scale <= 0 {
 			log.Fatal(errors.New("scale must be positive"))
 		}
+		if chunkSize <= 0 {
+			log.Fatal(errors.New("chunk size must be positive"))
+		}
+		if _, err := algoByID(compression); err != nil {
+			log.Fatal(err)
+		}
+		if parallel <= 0 {
+			log.Fatal(errors.New("parallel must be positive"))
+		}
 		if _, err := os.Stat(tmpDir); err != nil {
 			if os.IsNotExist(err) {
 				log.Fatal(errors.New("tmpDir does not exist"))
@@ -331,6 +1138,15 @@ func main() {
 		if outputRatio < 0 || outputRatio > 100 {
 			log.Fatal(errors.New("output ratio must between 0 and 100 (inclusive)"))
 		}
+		if chunkSize <= 0 {
+			log.Fatal(errors.New("chunk size must be positive"))
+		}
+		if _, err := algoByID(compression); err != nil {
+			log.Fatal(err)
+		}
+		if parallel <= 0 {
+			log.Fatal(errors.New("parallel must be positive"))
+		}
 		if _, err := os.Stat(tmpDir); err != nil {
 			if os.IsNotExist(err) {
 				log.Fatal(errors.New("tmpDir does not exist"))
@@ -338,19 +1154,46 @@ func main() {
 			log.Fatal(err)
 		}
 
-		var (
-			err  error
-			data []*comparableRow
-		)
-		cLog("Loading...")
-		start := time.Now()
-		data, err = load(inputRatio)
+		fileName := path.Join(tmpDir, "data.out")
+		fd, err := os.Open(fileName)
+		if os.IsNotExist(err) {
+			log.Fatal(errors.New("data file (data.out) does not exist"))
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
-		cLog("Done!")
-		cLog("Time used: ", time.Since(start))
-		cLogf("data size: %d", len(data))
+		defer fd.Close()
+
+		if err = decodeMeta(fd); err != nil {
+			log.Fatal(err)
+		}
+		cLogf("\tnumber of rows = %d, key size = %d, value size = %d", scale, keySize, valSize)
+
+		in, err := newChunkRowCursor(fd)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		totalInputRows := int(float64(scale) * (float64(inputRatio) / 100.0))
+		totalOutputRows := int(float64(scale) * (float64(outputRatio) / 100.0))
+
+		cLog("Partitioning and spilling...")
+		runFiles, partitionTime, spillTime, err := partitionAndSpill(in, totalInputRows)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cLogf("\t%d runs spilled to %s", len(runFiles), tmpDir)
+		cLog("Partition time used: ", partitionTime)
+		cLog("Spill time used: ", spillTime)
+
+		cLog("Merging...")
+		start := time.Now()
+		if err = mergeRuns(runFiles, totalOutputRows); err != nil {
+			log.Fatal(err)
+		}
+		mergeTime := time.Since(start)
+		cLog("Merge time used: ", mergeTime)
+		cLogf("Sorted output placed in: %s", path.Join(tmpDir, "sorted.out"))
 	}
 }
 
@@ -0,0 +1,151 @@
+// Copyright 2017 PingCAP, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestExternalMergeSortEndToEnd(t *testing.T) {
+	tmpDir = t.TempDir()
+	keySize, valSize = 2, 2
+	scale = 1000
+	bufSize = 64
+	chunkSize = 256
+	compression = compressionNone
+	parallel = 4
+
+	if err := export(); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	fd, err := os.Open(path.Join(tmpDir, "data.out"))
+	if err != nil {
+		t.Fatalf("open data.out: %v", err)
+	}
+	defer fd.Close()
+
+	if err := decodeMeta(fd); err != nil {
+		t.Fatalf("decodeMeta: %v", err)
+	}
+
+	in, err := newChunkRowCursor(fd)
+	if err != nil {
+		t.Fatalf("newChunkRowCursor: %v", err)
+	}
+
+	runFiles, _, _, err := partitionAndSpill(in, scale)
+	if err != nil {
+		t.Fatalf("partitionAndSpill: %v", err)
+	}
+
+	if err := mergeRuns(runFiles, scale); err != nil {
+		t.Fatalf("mergeRuns: %v", err)
+	}
+
+	sorted, err := os.Open(path.Join(tmpDir, "sorted.out"))
+	if err != nil {
+		t.Fatalf("open sorted.out: %v", err)
+	}
+	defer sorted.Close()
+
+	var prev *comparableRow
+	count := 0
+	for {
+		row, rerr := decodeRow(sorted)
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			t.Fatalf("decodeRow: %v", rerr)
+		}
+		if prev != nil {
+			cmp, cerr := compareKeys(prev.key, row.key)
+			if cerr != nil {
+				t.Fatalf("compareKeys: %v", cerr)
+			}
+			if cmp > 0 {
+				t.Fatalf("sorted.out not sorted: row %d is out of order", count)
+			}
+		}
+		prev = row
+		count++
+	}
+	if count != scale {
+		t.Fatalf("got %d rows in sorted.out, want %d", count, scale)
+	}
+}
+
+// TestMergeRunsOutputCap checks that mergeRuns writes exactly
+// totalOutputRows rows to sorted.out when the runs hold more than that.
+func TestMergeRunsOutputCap(t *testing.T) {
+	tmpDir = t.TempDir()
+	keySize, valSize = 2, 2
+	scale = 1000
+	bufSize = 64
+	chunkSize = 256
+	compression = compressionNone
+	parallel = 4
+
+	if err := export(); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	fd, err := os.Open(path.Join(tmpDir, "data.out"))
+	if err != nil {
+		t.Fatalf("open data.out: %v", err)
+	}
+	defer fd.Close()
+
+	if err := decodeMeta(fd); err != nil {
+		t.Fatalf("decodeMeta: %v", err)
+	}
+
+	in, err := newChunkRowCursor(fd)
+	if err != nil {
+		t.Fatalf("newChunkRowCursor: %v", err)
+	}
+
+	runFiles, _, _, err := partitionAndSpill(in, scale)
+	if err != nil {
+		t.Fatalf("partitionAndSpill: %v", err)
+	}
+
+	const outputCap = 10
+	if err := mergeRuns(runFiles, outputCap); err != nil {
+		t.Fatalf("mergeRuns: %v", err)
+	}
+
+	sorted, err := os.Open(path.Join(tmpDir, "sorted.out"))
+	if err != nil {
+		t.Fatalf("open sorted.out: %v", err)
+	}
+	defer sorted.Close()
+
+	count := 0
+	for {
+		if _, rerr := decodeRow(sorted); rerr == io.EOF {
+			break
+		} else if rerr != nil {
+			t.Fatalf("decodeRow: %v", rerr)
+		}
+		count++
+	}
+	if count != outputCap {
+		t.Fatalf("got %d rows in sorted.out, want %d", count, outputCap)
+	}
+}